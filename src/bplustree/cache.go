@@ -17,8 +17,8 @@
 package bplustree
 
 import (
+  "sync"
   "unsafe"
-  "C"
 )
 
 /* Allowed values for second argument to ManageDirtyList() */
@@ -30,25 +30,153 @@ const (
   PGHDR_DIRTY = 2
 )
 
-type Bulk struct {
-	addr uintptr
-	len  int
-	cap  int
+/*
+** PageCache is the interface implemented by every pluggable pgHdr cache
+** backend, mirroring SQLite's sqlite3_pcache_methods2 module.  A backend
+** owns the storage for a single btree's pages; the btree layer only ever
+** talks to the cache through this interface, so alternate policies (an
+** mmap-backed cache, an off-heap arena cache, a cache shared across a
+** PGroup) can be substituted without touching the btree layer.
+*/
+type PageCache interface {
+  /* Configure a freshly constructed cache for a given page size. bPurgeable
+  ** is true if the pager may ask the cache to discard pages to make room
+  ** for others; caches holding non-purgeable content never evict. */
+  Create(szPage int, bPurgeable bool)
+
+  /* Set the suggested maximum pgHdr count ("cache_size"). */
+  CacheSize(n int)
+
+  /* Fetch looks up key, creating a new pgHdr when createFlag is non-zero
+  ** and no entry is found. */
+  Fetch(key int, createFlag int) *PgHdr
+
+  /* Unpin releases a reference obtained from Fetch. When discard is true
+  ** and this call releases the last reference, the pgHdr is dropped from
+  ** the cache immediately instead of being recycled through the LRU list;
+  ** a pgHdr still pinned by another holder stays cached. */
+  Unpin(p *PgHdr, discard bool)
+
+  /* Rekey changes the key under which p is stored, e.g. when a pgHdr is
+  ** relocated to a new pgno during a vacuum. */
+  Rekey(p *PgHdr, oldKey, newKey int)
+
+  /* Truncate discards every pgHdr with a key greater than limit. */
+  Truncate(limit int)
+
+  /* Destroy releases every resource owned by the cache. The cache must
+  ** not be used again afterwards. */
+  Destroy()
+}
+
+/*
+** Global registry of PageCache backend constructors, keyed by name.  An
+** embedding application registers a backend with RegisterPageCache and
+** selects it by name with NewPageCache; the bulk-allocation implementation
+** below registers itself as "default".
+*/
+var pageCacheRegistry = map[string]func() PageCache{}
+
+/*
+** RegisterPageCache makes a PageCache backend available under name. It
+** panics if name is already registered.
+*/
+func RegisterPageCache(name string, newCache func() PageCache) {
+  if _, ok := pageCacheRegistry[name]; ok {
+    panic("bplustree: PageCache backend already registered: " + name)
+  }
+  pageCacheRegistry[name] = newCache
+}
+
+/*
+** NewPageCache constructs a fresh PageCache backend previously registered
+** under name. ok is false if no such backend exists.
+*/
+func NewPageCache(name string) (cache PageCache, ok bool) {
+  newCache, ok := pageCacheRegistry[name]
+  if !ok {
+    return nil, false
+  }
+  return newCache(), true
 }
 
-type PageData Bulk
-type CacheData Bulk
+func init() {
+  RegisterPageCache("default", func() PageCache { return &PCache{} })
+}
+
+/*
+** PageData holds the raw database content bytes for one pgHdr. It is a
+** normal heap-allocated slice, not a pointer carved out of a larger
+** unsafe.Pointer-addressed arena, so the garbage collector can see and
+** trace it like any other Go value.
+*/
+type PageData struct {
+  buf []byte
+}
 
+/*
+** PGroup owns the mutex that serializes every mutating operation across
+** the PCache instances that share it (FetchPage, AllocPage, FreePage,
+** RemoveFromHash, ResizeHash, ManageDirtyList, MakeDirty, MakeClean).
+** Caches that share a PGroup also share a single eviction pool: when one
+** cache's own LRU and dirty lists have nothing left to recycle,
+** FetchPage's Step 4 may steal an unpinned victim from another member
+** instead of growing, as in SQLite's PGroup model.
+**
+** The pcache1-style helpers in this file (ResizeHash, RemoveFromHash,
+** lruRemove, ManageDirtyList, AllocPage, FreePage, TruncateUnsafe, ...)
+** all assume the caller already holds pGroup's mutex; only the methods
+** called directly by the btree/pager layer (FetchPage, the PageCache
+** interface methods other than Create, MakeDirty/MakeClean) acquire it
+** themselves. Create runs its ResizeHash and InitBulk calls without
+** holding the mutex.
+*/
+type PGroup struct {
+  mu sync.Mutex
+  members []*PCache
+}
+
+/*
+** NewPGroup returns a freshly initialized, empty PGroup.
+*/
+func NewPGroup() *PGroup {
+  return &PGroup{}
+}
+
+/*
+** removeMemberLocked drops pCache from g's member list. g.mu must already
+** be held.
+*/
+func (g *PGroup) removeMemberLocked(pCache *PCache) {
+  for i, m := range g.members {
+    if m == pCache {
+      g.members = append(g.members[:i], g.members[i+1:]...)
+      return
+    }
+  }
+}
+
+/* PCache is the default, bulk-allocating PageCache backend. */
 type PCache struct {
   szPage int                         /* Size of database content section */
   szAlloc int                     /* Total size of one pcache line */
   nMin int                  /* Minimum number of pages reserved */
   nMax int                  /* Configured "cache_size" value */
-  pBulk *CacheData
-  pLru *PgHdr
+  bPurgeable bool                 /* True if pages may be discarded to make room */
+  nRefSum int                  /* Sum of nRef over all pages in the cache */
+  pGroup *PGroup                  /* Group whose mutex and eviction pool this cache shares */
+  pBulk [][]PgHdr                  /* Bulk-allocated, GC-visible slabs of pgHdr objects */
+  pOverflow sync.Pool              /* Overflow allocator for AllocPage once pFree is empty */
+  pLru *PgHdr                     /* Head (oldest) of LRU list of unpinned pages */
+  pLruTail *PgHdr                 /* Tail (newest) of LRU list of unpinned pages */
   pFree *PgHdr                     /* Next in hash table chain */
   pDirty *PgHdr                     /* Next in hash table chain */
   pDirtyTail *PgHdr
+  pSynced *PgHdr                  /* Most recent dirty pgHdr already in the journal */
+  nDirty int                  /* Number of pages in the pDirty/pDirtyTail list */
+  szSpill int                  /* Size of cache before spilling dirty pages */
+  xStress StressFunc           /* Callback to write a dirty pgHdr back */
+  pStress interface{}          /* First argument to xStress */
 
   /* Hash table of all pages. The following variables may only be accessed
   ** when the accessor is holding the PGroup mutex.
@@ -74,10 +202,12 @@ type PgHdr struct {
   iKey int                     /* Page number for this pgHdr */
   flag int                     /* Dirty of Clean*/
   isBulkLocal int
+  nRef int                     /* Number of users of this pgHdr */
   pBulk *PageData                   /* Page data */
 
   pCache *PCache              /* PRIVATE: Cache that owns this pgHdr */
-  pNext *PgHdr                 /* Transient list of dirty sorted by pgno */
+  pNext *PgHdr                 /* Next pgHdr in the same hash-bucket collision chain */
+  pSortNext *PgHdr             /* Transient list of dirty pages sorted by pgno, used only by DirtyListSortedByKey */
   pFreeNext *PgHdr                 /* Transient list of dirty sorted by pgno */
   pDirtyNext *PgHdr             /* Next element in list of dirty pages */
   pDirtyPrev *PgHdr             /* Previous element in list of dirty pages */
@@ -90,9 +220,18 @@ type PgHdr struct {
 **
 ** Allocate a new cache.
 */
-func (pCache *PCache) Create(szPage int) {
+func (pCache *PCache) Create(szPage int, bPurgeable bool) {
   pCache.szPage = szPage
+  pCache.bPurgeable = bPurgeable
   pCache.szAlloc = szPage + int(unsafe.Sizeof(&PgHdr{}))
+  pCache.pOverflow.New = func() interface{} {
+    return &PgHdr{}
+  }
+  if pCache.pGroup == nil {
+    /* No SetPGroup call yet: give the cache a private group of one. */
+    pCache.pGroup = NewPGroup()
+    pCache.pGroup.members = append(pCache.pGroup.members, pCache)
+  }
   // pcache1EnterMutex(pGroup);
   pCache.ResizeHash()
   // pcache1LeaveMutex(pGroup);
@@ -102,33 +241,129 @@ func (pCache *PCache) Create(szPage int) {
   pCache.InitBulk()
 }
 
+/*
+** SetPGroup moves pCache into group g, sharing g's mutex and eviction
+** pool with every other cache already in it. Caches only make sensible
+** eviction partners when they share the same page size.
+*/
+func (pCache *PCache) SetPGroup(g *PGroup) {
+  if pCache.pGroup != nil {
+    pCache.pGroup.mu.Lock()
+    pCache.pGroup.removeMemberLocked(pCache)
+    pCache.pGroup.mu.Unlock()
+  }
+  pCache.pGroup = g
+  g.mu.Lock()
+  g.members = append(g.members, pCache)
+  g.mu.Unlock()
+}
+
+/*
+** Implementation of the CacheSize method.
+**
+** Set the suggested maximum cache size.
+*/
+func (pCache *PCache) CacheSize(n int) {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  pCache.nMax = n
+}
+
+/*
+** Implementation of the Fetch method.
+**
+** Look up key in the hash table, optionally creating a new pgHdr for it
+** when createFlag is non-zero and no entry is found.
+*/
+func (pCache *PCache) Fetch(key int, createFlag int) *PgHdr {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  if createFlag == 0 {
+    pgHdr := pCache.apHash[key % pCache.nHash]
+    for pgHdr != nil {
+      if pgHdr.iKey == key {
+        pCache.PinPage(pgHdr)
+        return pgHdr
+      }
+      pgHdr = pgHdr.pNext
+    }
+    return nil
+  }
+  return pCache.fetchPageLocked(key)
+}
+
+/*
+** Implementation of the Unpin method.
+**
+** Release a reference obtained from Fetch. If this was the last reference,
+** discard drops the pgHdr from the cache immediately rather than leaving
+** it to be recycled; otherwise the pgHdr stays cached.
+*/
+func (pCache *PCache) Unpin(p *PgHdr, discard bool) {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  pCache.UnpinPage(p)
+  if discard && p.nRef == 0 {
+    if pCache.inLru(p) {
+      pCache.lruRemove(p)
+    }
+    pCache.RemoveFromHash(p)
+  }
+}
+
+/*
+** Implementation of the Rekey method.
+**
+** Move pgHdr p from oldKey to newKey within the hash table.
+*/
+func (pCache *PCache) Rekey(p *PgHdr, oldKey, newKey int) {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  h := oldKey % pCache.nHash
+  pp := &pCache.apHash[h]
+  for *pp != nil {
+    if *pp == p {
+      *pp = (*pp).pNext
+      break
+    }
+    pp = &((*pp).pNext)
+  }
+  p.iKey = newKey
+  nh := newKey % pCache.nHash
+  p.pNext = pCache.apHash[nh]
+  pCache.apHash[nh] = p
+}
+
+/*
+** Implementation of the Truncate method.
+**
+** Discard every pgHdr with a key greater than limit.
+*/
+func (pCache *PCache) Truncate(limit int) {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  pCache.TruncateUnsafe(limit)
+}
+
 /*
 ** Try to initialize the pCache.pFree and pCache.pBulk fields.  Return
 ** true if pCache.pFree ends up containing one or more free pages.
 */
 func (pCache *PCache) InitBulk() *PgHdr {
   /* Do not bother with a bulk allocation if the cache size very small */
-  var szBulk int
-  if pCache.nInitPage>0 {
-    szBulk = pCache.szAlloc * pCache.nInitPage
+  var nBulk int
+  if pCache.nInitPage > 0 {
+    nBulk = pCache.nInitPage
   } else {
-    szBulk = pCache.szAlloc * 1024
-  }
-  pBulk := C.malloc(C.size_t(szBulk))
-
-  pCache.pBulk = &CacheData{
-    addr: uintptr(unsafe.Pointer(pBulk)),
-    len:  szBulk,
-    cap:  szBulk,
-  }
-  nBulk := szBulk/pCache.szAlloc
-  for i:= 0; i < nBulk; i++ {
-    pX := (*PgHdr)(unsafe.Pointer(uintptr(unsafe.Pointer(pBulk))+uintptr(i*pCache.szAlloc)))
-    pX.pBulk = &PageData{
-      addr: uintptr(unsafe.Pointer(pBulk))+uintptr(i*pCache.szAlloc),
-      len:  pCache.szAlloc,
-      cap:  pCache.szAlloc,
-    }
+    nBulk = 1024
+  }
+  slab := make([]PgHdr, nBulk)
+  pCache.pBulk = append(pCache.pBulk, slab)
+
+  for i := range slab {
+    pX := &slab[i]
+    pX.pBulk = &PageData{buf: make([]byte, pCache.szPage)}
+    pX.isBulkLocal = 1
     pX.pFreeNext = pCache.pFree
     pCache.pFree = pX
   }
@@ -142,13 +377,188 @@ func (pCache *PCache) InitBulk() *PgHdr {
 ** Destroy a cache allocated using Create().
 */
 func (pCache *PCache) Destroy(){
-  // if( pCache.nPage ) pcache1TruncateUnsafe(pCache, 0);
-  // free(pCache.apHash);
-  // free(pBulk)
-  // free(pCache);
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  if pCache.nPage > 0 {
+    pCache.TruncateUnsafe(0)
+  }
+  /* Return every overflow (non-bulk) pgHdr still on the free list to the
+  ** sync.Pool it came from; bulk-local ones are simply dropped along with
+  ** pCache.pBulk below and reclaimed by the GC. */
+  for p := pCache.pFree; p != nil; {
+    next := p.pFreeNext
+    if p.isBulkLocal == 0 {
+      pCache.pOverflow.Put(p)
+    }
+    p = next
+  }
+  pCache.pGroup.removeMemberLocked(pCache)
+  pCache.apHash = nil
+  pCache.pBulk = nil
+  pCache.pFree = nil
+  pCache.pLru = nil
+  pCache.pLruTail = nil
+}
+
+/*
+** inLru reports whether p currently sits on the LRU list of unpinned
+** pages. Callers must check this before lruRemove, since a page that was
+** never unpinned (e.g. freshly allocated) has nil pLruNext/pLruPrev too.
+*/
+func (pCache *PCache) inLru(p *PgHdr) bool {
+  return p == pCache.pLru || p == pCache.pLruTail || p.pLruPrev != nil || p.pLruNext != nil
+}
+
+/*
+** lruAppend splices p onto the tail of the LRU list, i.e. the
+** most-recently-unpinned end. The head of the list (pCache.pLru) is
+** therefore always the oldest unpinned page, the next eviction victim.
+*/
+func (pCache *PCache) lruAppend(p *PgHdr) {
+  p.pLruNext = nil
+  p.pLruPrev = pCache.pLruTail
+  if pCache.pLruTail != nil {
+    pCache.pLruTail.pLruNext = p
+  } else {
+    pCache.pLru = p
+  }
+  pCache.pLruTail = p
+}
+
+/*
+** lruRemove unlinks p from the LRU list. p must currently be on the list
+** (see inLru).
+*/
+func (pCache *PCache) lruRemove(p *PgHdr) {
+  if p.pLruNext != nil {
+    p.pLruNext.pLruPrev = p.pLruPrev
+  } else {
+    pCache.pLruTail = p.pLruPrev
+  }
+  if p.pLruPrev != nil {
+    p.pLruPrev.pLruNext = p.pLruNext
+  } else {
+    pCache.pLru = p.pLruNext
+  }
+  p.pLruNext = nil
+  p.pLruPrev = nil
+}
+
+/*
+** PinPage increments the pgHdr's reference count. If the pgHdr was
+** unreferenced, it is first unlinked from the LRU list, since a pinned
+** page is never a candidate for eviction.
+*/
+func (pCache *PCache) PinPage(p *PgHdr) {
+  if p == nil {
+    return
+  }
+  if p.nRef == 0 {
+    if pCache.inLru(p) {
+      pCache.lruRemove(p)
+    }
+    pCache.nRefSum++
+  }
+  p.nRef++
+}
+
+/*
+** UnpinPage decrements the pgHdr's reference count. Once the count
+** reaches zero the pgHdr becomes a recycling candidate and is appended
+** to the tail of the LRU list.
+*/
+func (pCache *PCache) UnpinPage(p *PgHdr) {
+  if p == nil || p.nRef <= 0 {
+    return
+  }
+  p.nRef--
+  if p.nRef == 0 {
+    pCache.nRefSum--
+    pCache.lruAppend(p)
+  }
+}
+
+/*
+** TruncateUnsafe discards every pgHdr with a key greater than above,
+** removing it from both the hash table and the LRU list. The PGroup
+** mutex must be held by the caller (hence "Unsafe").
+*/
+func (pCache *PCache) TruncateUnsafe(above int) {
+  for h := 0; h < pCache.nHash; h++ {
+    pgHdr := pCache.apHash[h]
+    for pgHdr != nil {
+      next := pgHdr.pNext
+      if pgHdr.iKey > above {
+        if pgHdr.nRef == 0 && pCache.inLru(pgHdr) {
+          pCache.lruRemove(pgHdr)
+        }
+        pCache.RemoveFromHash(pgHdr)
+      }
+      pgHdr = next
+    }
+  }
 }
 
+/*
+** FetchPage is the public, concurrency-safe entry point used by the
+** btree layer. It acquires pGroup's mutex for the duration of the lookup
+** and possible recycle/allocate, then delegates to fetchPageLocked.
+*/
 func (pCache *PCache) FetchPage(iKey int) *PgHdr {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  return pCache.fetchPageLocked(iKey)
+}
+
+/*
+** localVictimLocked returns the oldest clean, unpinned pgHdr on pCache's
+** own LRU list, spilling the oldest journaled dirty page via trySpill if
+** every unpinned page turns out to be dirty. Caches created with
+** bPurgeable false never give up a page this way. The caller must hold
+** pGroup's mutex.
+*/
+func (pCache *PCache) localVictimLocked() *PgHdr {
+  if !pCache.bPurgeable {
+    return nil
+  }
+  victim := pCache.pLru
+  for victim != nil && victim.flag & PGHDR_DIRTY != 0 {
+    victim = victim.pLruNext
+  }
+  if victim == nil {
+    victim = pCache.trySpill()
+  }
+  return victim
+}
+
+/*
+** recycleVictimLocked looks for a pgHdr to recycle, preferring pCache's
+** own lists but falling back to the other caches sharing its PGroup (only
+** purgeable caches with an identical szAlloc are viable eviction
+** partners). Returns the victim and the PCache it currently belongs to,
+** or nil, nil if nothing is recyclable anywhere in the group. The caller
+** must hold pGroup's mutex.
+*/
+func (pCache *PCache) recycleVictimLocked() (*PgHdr, *PCache) {
+  if v := pCache.localVictimLocked(); v != nil {
+    return v, pCache
+  }
+  for _, sibling := range pCache.pGroup.members {
+    if sibling == pCache || !sibling.bPurgeable || sibling.szAlloc != pCache.szAlloc {
+      continue
+    }
+    if v := sibling.localVictimLocked(); v != nil {
+      return v, sibling
+    }
+  }
+  return nil, nil
+}
+
+/*
+** fetchPageLocked is the core FetchPage algorithm. The caller must hold
+** pGroup's mutex.
+*/
+func (pCache *PCache) fetchPageLocked(iKey int) *PgHdr {
 
   /* Step 1: Search the hash table for an existing entry. */
   /* Step 2: If the pgHdr was found in the hash table, then return it.
@@ -157,6 +567,7 @@ func (pCache *PCache) FetchPage(iKey int) *PgHdr {
   pgHdr := pCache.apHash[iKey % pCache.nHash];
   for pgHdr != nil {
     if pgHdr.iKey == iKey {
+      pCache.PinPage(pgHdr)
       return pgHdr
     }
     pgHdr = pgHdr.pNext
@@ -166,11 +577,17 @@ func (pCache *PCache) FetchPage(iKey int) *PgHdr {
   if pCache.nPage>=pCache.nHash {
     pCache.ResizeHash()
   }
-  /* Step 4. Try to recycle a pgHdr. */
-  /*if pCache.nPage+1 >= pCache.nMax  {
-    pgHdr = pCache.pLru
-    pCache.RemoveFromHash(pgHdr)
-  }*/
+  /* Step 4. Try to recycle a pgHdr, from this cache or, failing that,
+  ** from another cache sharing its PGroup. */
+  if pgHdr == nil && pCache.nPage >= pCache.nMax {
+    if victim, owner := pCache.recycleVictimLocked(); victim != nil {
+      owner.lruRemove(victim)
+      owner.RemoveFromHash(victim)
+      owner.pFree = victim.pFreeNext
+      victim.pFreeNext = nil
+      pgHdr = victim
+    }
+  }
   /* Step 5. If a usable pgHdr buffer has still not been found,
   ** attempt to allocate a new one.
   */
@@ -182,13 +599,15 @@ func (pCache *PCache) FetchPage(iKey int) *PgHdr {
     h := iKey % pCache.nHash
     pCache.nPage++
     pgHdr.iKey = iKey
+    pgHdr.flag = PGHDR_CLEAN
     pgHdr.pNext = pCache.apHash[h]
     pgHdr.pCache = pCache
     pgHdr.pLruPrev = nil
     pgHdr.pLruNext = nil
+    pgHdr.nRef = 0
     pCache.apHash[h] = pgHdr
+    pCache.PinPage(pgHdr)
   }
-  println("allocpage:%d", len(*(*[]byte)(unsafe.Pointer(pgHdr.pBulk))))
   return pgHdr;
 }
 
@@ -202,13 +621,9 @@ func (pCache *PCache) AllocPage() *PgHdr {
     pgHdr.pFreeNext = nil
     return pgHdr
   }
-  pBulk := C.malloc(C.size_t(pCache.szAlloc))
-  pgHdr := (*PgHdr)(unsafe.Pointer(pBulk))
-  pgHdr.pBulk = &PageData{
-    addr: uintptr(unsafe.Pointer(pBulk)),
-    len:  pCache.szAlloc,
-    cap:  pCache.szAlloc,
-  }
+  pgHdr := pCache.pOverflow.Get().(*PgHdr)
+  *pgHdr = PgHdr{}
+  pgHdr.pBulk = &PageData{buf: make([]byte, pCache.szPage)}
   pgHdr.isBulkLocal = 0
   return pgHdr
 }
@@ -284,9 +699,10 @@ func (pCache *PCache) ManageDirtyList(pgHdr *PgHdr, addRemove uint8){
   if addRemove & PCACHE_DIRTYLIST_REMOVE == 1 {
 
     /* Update the PCache.pSynced variable if necessary. */
-    // if( p.pSynced==pgHdr ){
-    //   p.pSynced = pgHdr.pDirtyPrev;
-    // }
+    if pCache.pSynced == pgHdr {
+      pCache.pSynced = pgHdr.pDirtyNext
+    }
+    pCache.nDirty--
 
     if pgHdr.pDirtyNext != nil {
       pgHdr.pDirtyNext.pDirtyPrev = pgHdr.pDirtyPrev
@@ -305,7 +721,7 @@ func (pCache *PCache) ManageDirtyList(pgHdr *PgHdr, addRemove uint8){
     pgHdr.pDirtyNext = nil
     pgHdr.pDirtyPrev = nil
   }
-  if addRemove & PCACHE_DIRTYLIST_ADD == 1 {
+  if addRemove & PCACHE_DIRTYLIST_ADD != 0 {
     pgHdr.pDirtyNext = pCache.pDirty;
     if pgHdr.pDirtyNext != nil {
       pgHdr.pDirtyNext.pDirtyPrev = pgHdr;
@@ -313,7 +729,66 @@ func (pCache *PCache) ManageDirtyList(pgHdr *PgHdr, addRemove uint8){
       pCache.pDirtyTail = pgHdr;
     }
     pCache.pDirty = pgHdr;
+    pCache.nDirty++
+  }
+}
+
+/*
+** StressFunc is called to write a single dirty pgHdr back to the journal
+** or database file, as the last resort before the cache runs out of
+** memory. Returning a non-nil error leaves the pgHdr dirty and tells the
+** spill loop to try the next, newer candidate.
+*/
+type StressFunc func(ctx interface{}, p *PgHdr) error
+
+/*
+** SetStress installs the spill callback used to bound memory when no
+** clean, unpinned pgHdr is available to recycle. xStress is invoked on
+** dirty, unpinned pages once nDirty exceeds szSpill.
+*/
+func (pCache *PCache) SetStress(ctx interface{}, szSpill int, xStress StressFunc) {
+  pCache.pStress = ctx
+  pCache.szSpill = szSpill
+  pCache.xStress = xStress
+}
+
+/*
+** MarkSynced records that pgHdr has been safely written to the journal.
+** The pager must call this once per dirty pgHdr, in the same oldest-to-
+** newest order it writes them to the journal, so that pSynced always
+** names the newest journaled pgHdr and trySpill can treat every dirty
+** pgHdr from pDirtyTail up through it as a safe eviction candidate.
+*/
+func (pCache *PCache) MarkSynced(pgHdr *PgHdr) {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  pCache.pSynced = pgHdr
+}
+
+/*
+** trySpill walks the dirty list from pDirtyTail backwards (i.e. from the
+** oldest dirty pgHdr towards the newest), stopping at pSynced, so that
+** only pages already known to be safely written to the journal are
+** candidates. The first unpinned page the callback accepts is marked
+** clean and returned so the caller can recycle it; nil means none of the
+** journaled dirty pages could be spilled.
+*/
+func (pCache *PCache) trySpill() *PgHdr {
+  if pCache.xStress == nil || pCache.pSynced == nil || pCache.nDirty <= pCache.szSpill {
+    return nil
+  }
+  for p := pCache.pDirtyTail; p != nil; p = p.pDirtyPrev {
+    if p.nRef == 0 {
+      if err := pCache.xStress(pCache.pStress, p); err == nil {
+        pCache.makeCleanLocked(p)
+        return p
+      }
+    }
+    if p == pCache.pSynced {
+      break
+    }
   }
+  return nil
 }
 
 /*
@@ -321,6 +796,12 @@ func (pCache *PCache) ManageDirtyList(pgHdr *PgHdr, addRemove uint8){
 ** make it so.
 */
 func (pCache *PCache) MakeDirty(pgHdr *PgHdr){
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  pCache.makeDirtyLocked(pgHdr)
+}
+
+func (pCache *PCache) makeDirtyLocked(pgHdr *PgHdr){
   if pgHdr.flag & PGHDR_CLEAN != 0 {
     pgHdr.flag ^= (PGHDR_DIRTY|PGHDR_CLEAN)
     pCache.ManageDirtyList(pgHdr, PCACHE_DIRTYLIST_ADD)
@@ -332,6 +813,12 @@ func (pCache *PCache) MakeDirty(pgHdr *PgHdr){
 ** make it so.
 */
 func (pCache *PCache) MakeClean(pgHdr *PgHdr){
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  pCache.makeCleanLocked(pgHdr)
+}
+
+func (pCache *PCache) makeCleanLocked(pgHdr *PgHdr){
   if (pgHdr.flag & PGHDR_DIRTY) != 0 {
     pCache.ManageDirtyList(pgHdr, PCACHE_DIRTYLIST_REMOVE)
     pgHdr.flag &= ^(PGHDR_DIRTY)
@@ -343,8 +830,94 @@ func (pCache *PCache) MakeClean(pgHdr *PgHdr){
 ** Make every pgHdr in the cache clean.
 */
 func (pCache *PCache) MakeCleanAll(){
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
   for pCache.pDirty != nil {
     p := pCache.pDirty
-    pCache.MakeClean(p)
+    pCache.makeCleanLocked(p)
+  }
+}
+
+/*
+** mergeDirtyLists merges two already-sorted transient lists, threaded
+** through PgHdr.pSortNext, into one list ascending by iKey.
+*/
+func mergeDirtyLists(pA, pB *PgHdr) *PgHdr {
+  var head PgHdr
+  pTail := &head
+  for pA != nil && pB != nil {
+    if pA.iKey < pB.iKey {
+      pTail.pSortNext = pA
+      pTail = pA
+      pA = pA.pSortNext
+    } else {
+      pTail.pSortNext = pB
+      pTail = pB
+      pB = pB.pSortNext
+    }
+  }
+  if pA != nil {
+    pTail.pSortNext = pA
+  } else {
+    pTail.pSortNext = pB
+  }
+  return head.pSortNext
+}
+
+/*
+** DirtyListSortedByKey returns the head of a transient singly-linked list,
+** threaded through PgHdr.pSortNext, of every currently dirty pgHdr sorted in
+** ascending order by iKey. A pager/checkpoint routine can walk the result
+** to write dirty pages to disk in file order and minimize seek overhead.
+**
+** The sort is an in-place merge sort over the existing pDirtyNext chain:
+** each pgHdr is folded into a cascade of buckets sized 1, 2, 4, ... up to
+** 1<<30, merging two same-sized runs into the next bucket whenever one
+** fills, then all remaining buckets are cascade-merged into the final
+** list. The caller must not mutate the dirty list while iterating it.
+*/
+func (pCache *PCache) DirtyListSortedByKey() *PgHdr {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  const nBucket = 32
+  var apBucket [nBucket]*PgHdr
+
+  p := pCache.pDirty
+  for p != nil {
+    next := p.pDirtyNext
+    p.pSortNext = nil
+    i := 0
+    for ; i < nBucket-1; i++ {
+      if apBucket[i] == nil {
+        apBucket[i] = p
+        break
+      }
+      p = mergeDirtyLists(apBucket[i], p)
+      apBucket[i] = nil
+    }
+    if i == nBucket-1 {
+      apBucket[i] = mergeDirtyLists(apBucket[i], p)
+    }
+    p = next
+  }
+
+  var pList *PgHdr
+  for i := 0; i < nBucket; i++ {
+    pList = mergeDirtyLists(apBucket[i], pList)
+  }
+  return pList
+}
+
+/*
+** IterateDirty calls fn once for every currently dirty pgHdr, oldest
+** first (the same order the spill callback in trySpill considers
+** candidates). The traversal is read-only: fn must not mutate the dirty
+** or LRU lists.
+*/
+func (pCache *PCache) IterateDirty(fn func(*PgHdr)) {
+  pCache.pGroup.mu.Lock()
+  defer pCache.pGroup.mu.Unlock()
+  for p := pCache.pDirtyTail; p != nil; p = p.pDirtyPrev {
+    fn(p)
   }
 }
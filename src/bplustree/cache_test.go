@@ -0,0 +1,273 @@
+package bplustree
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func newTestPageCache(szPage, nMax int) *PCache {
+	pCache := &PCache{}
+	pCache.nInitPage = 64
+	pCache.Create(szPage, true)
+	pCache.CacheSize(nMax)
+	return pCache
+}
+
+/*
+** TestPGroupSharesEviction checks that two caches placed in the same
+** PGroup can recycle each other's unpinned pages: once pA is full, a
+** fetch on pA should be able to steal pB's oldest unpinned victim rather
+** than growing unboundedly.
+*/
+func TestPGroupSharesEviction(t *testing.T) {
+	pA := newTestPageCache(4096, 4)
+	pB := newTestPageCache(4096, 4)
+	g := NewPGroup()
+	pA.SetPGroup(g)
+	pB.SetPGroup(g)
+
+	for i := 0; i < 4; i++ {
+		p := pB.FetchPage(i)
+		pB.Unpin(p, false)
+	}
+	if pB.nPage != 4 {
+		t.Fatalf("pB.nPage = %d, want 4", pB.nPage)
+	}
+
+	/* Keep every pA fetch pinned so pA has no eviction candidates of its
+	** own; any recycling that happens must come from pB via the PGroup. */
+	for i := 0; i < 8; i++ {
+		pA.FetchPage(i)
+	}
+
+	if pB.nPage == 4 {
+		t.Fatalf("expected pA to steal at least one of pB's unpinned pages, pB.nPage stayed at 4")
+	}
+}
+
+/*
+** TestMakeDirtySpillsViaStress checks that MakeDirty actually flips a
+** page's flag and links it onto the dirty list (nDirty > 0), and that once
+** nDirty exceeds szSpill, FetchPage's recycle path calls the installed
+** stress callback to spill the oldest journaled dirty page rather than
+** growing the cache past nMax.
+*/
+func TestMakeDirtySpillsViaStress(t *testing.T) {
+	pCache := newTestPageCache(4096, 2)
+
+	p0 := pCache.FetchPage(0)
+	pCache.MakeDirty(p0)
+	if pCache.nDirty != 1 {
+		t.Fatalf("nDirty = %d, want 1 after MakeDirty", pCache.nDirty)
+	}
+	pCache.MarkSynced(p0)
+	pCache.Unpin(p0, false)
+
+	p1 := pCache.FetchPage(1)
+	pCache.MakeDirty(p1)
+	pCache.Unpin(p1, false)
+	if pCache.nDirty != 2 {
+		t.Fatalf("nDirty = %d, want 2 after second MakeDirty", pCache.nDirty)
+	}
+
+	/* Every unpinned page is now dirty, so FetchPage can only make room by
+	** spilling through xStress; pSynced marks p0 (key 0) as the only page
+	** safe to spill, since p1 (key 1) was never reported as journaled. */
+	var spilled []int
+	pCache.SetStress(nil, 0, func(ctx interface{}, p *PgHdr) error {
+		spilled = append(spilled, p.iKey)
+		return nil
+	})
+
+	pCache.FetchPage(2)
+
+	if len(spilled) != 1 || spilled[0] != 0 {
+		t.Fatalf("spilled = %v, want [0]", spilled)
+	}
+	if pCache.nDirty != 1 {
+		t.Fatalf("nDirty = %d, want 1 after spilling key 0, leaving key 1 dirty", pCache.nDirty)
+	}
+}
+
+/*
+** TestDirtyListSortedByKey checks that MakeDirty links pages onto
+** pCache.pDirty so DirtyListSortedByKey returns them in ascending iKey
+** order and IterateDirty visits every one of them.
+*/
+func TestDirtyListSortedByKey(t *testing.T) {
+	pCache := newTestPageCache(4096, 8)
+
+	keys := []int{3, 1, 2}
+	for _, k := range keys {
+		p := pCache.FetchPage(k)
+		pCache.MakeDirty(p)
+		pCache.Unpin(p, false)
+	}
+
+	var got []int
+	for p := pCache.DirtyListSortedByKey(); p != nil; p = p.pSortNext {
+		got = append(got, p.iKey)
+	}
+	want := []int{1, 2, 3}
+	if len(got) != len(want) {
+		t.Fatalf("DirtyListSortedByKey returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("DirtyListSortedByKey returned %v, want %v", got, want)
+		}
+	}
+
+	var visited []int
+	pCache.IterateDirty(func(p *PgHdr) {
+		visited = append(visited, p.iKey)
+	})
+	if len(visited) != len(keys) {
+		t.Fatalf("IterateDirty visited %v, want %d pages", visited, len(keys))
+	}
+}
+
+/*
+** TestAllocPageOverflowsPastBulk checks that once the initial bulk slab
+** (sized by nInitPage) is exhausted, AllocPage falls back to the
+** sync.Pool-backed overflow allocator and still hands out distinct,
+** independently usable pgHdrs, and that Destroy can tear down a cache
+** holding a mix of bulk-local and overflow pages without panicking.
+*/
+func TestAllocPageOverflowsPastBulk(t *testing.T) {
+	pCache := &PCache{}
+	pCache.nInitPage = 2
+	pCache.Create(4096, true)
+	pCache.CacheSize(16)
+
+	const nPages = 8
+	var pages [nPages]*PgHdr
+	for i := 0; i < nPages; i++ {
+		pages[i] = pCache.FetchPage(i)
+	}
+
+	sawBulkLocal, sawOverflow := false, false
+	for i, p := range pages {
+		if p == nil {
+			t.Fatalf("FetchPage(%d) returned nil", i)
+		}
+		if p.iKey != i {
+			t.Fatalf("pages[%d].iKey = %d, want %d", i, p.iKey, i)
+		}
+		if p.isBulkLocal != 0 {
+			sawBulkLocal = true
+		} else {
+			sawOverflow = true
+		}
+		pCache.Unpin(p, false)
+	}
+	if !sawBulkLocal || !sawOverflow {
+		t.Fatalf("sawBulkLocal=%v sawOverflow=%v, want both true once nInitPage=2 is exceeded by %d pages", sawBulkLocal, sawOverflow, nPages)
+	}
+
+	pCache.Destroy()
+}
+
+/*
+** TestUnpinDiscardKeepsSharedPage checks that Unpin(p, true) only removes
+** p from the hash table once every holder has released it: a page fetched
+** by two independent cursors must survive a discarding Unpin from one of
+** them as long as the other still holds a reference.
+*/
+func TestUnpinDiscardKeepsSharedPage(t *testing.T) {
+	pCache := newTestPageCache(4096, 8)
+
+	p := pCache.FetchPage(0)
+	p2 := pCache.FetchPage(0)
+	if p2 != p {
+		t.Fatalf("second FetchPage(0) = %p, want %p", p2, p)
+	}
+
+	pCache.Unpin(p, true)
+	if got := pCache.FetchPage(0); got != p {
+		t.Fatalf("FetchPage(0) after discarding Unpin while still pinned = %p, want %p (page evicted early)", got, p)
+	}
+	pCache.Unpin(p, false)
+
+	pCache.Unpin(p, true)
+	got := pCache.FetchPage(0)
+	if got.iKey != 0 || got.flag != PGHDR_CLEAN {
+		t.Fatalf("FetchPage(0) after final discarding Unpin = %+v, want a freshly installed clean page for key 0", got)
+	}
+	pCache.Unpin(got, false)
+}
+
+/*
+** TestPageCacheInterface drives the default backend entirely through the
+** PageCache interface (Fetch/Unpin/Rekey/Truncate/Destroy) rather than the
+** *PCache methods directly, and checks that a page found by Fetch with
+** createFlag==0 comes back pinned just like one created with createFlag!=0.
+*/
+func TestPageCacheInterface(t *testing.T) {
+	backend, ok := NewPageCache("default")
+	if !ok {
+		t.Fatal("default PageCache backend not registered")
+	}
+	backend.Create(4096, true)
+	backend.CacheSize(8)
+
+	p := backend.Fetch(1, 1)
+	if p == nil {
+		t.Fatal("Fetch(1, 1) returned nil")
+	}
+	if p.nRef != 1 {
+		t.Fatalf("Fetch(1, 1) left nRef = %d, want 1", p.nRef)
+	}
+	backend.Unpin(p, false)
+
+	p2 := backend.Fetch(1, 0)
+	if p2 != p {
+		t.Fatalf("Fetch(1, 0) = %p, want %p", p2, p)
+	}
+	if p2.nRef != 1 {
+		t.Fatalf("Fetch(1, 0) left nRef = %d, want 1", p2.nRef)
+	}
+	backend.Unpin(p2, false)
+
+	backend.Rekey(p, 1, 2)
+	if got := backend.Fetch(1, 0); got != nil {
+		t.Fatalf("Fetch(1, 0) after Rekey(1, 2) = %p, want nil", got)
+	}
+	got := backend.Fetch(2, 0)
+	if got != p {
+		t.Fatalf("Fetch(2, 0) after Rekey(1, 2) = %p, want %p", got, p)
+	}
+	backend.Unpin(got, false)
+
+	backend.Truncate(0)
+	if got := backend.Fetch(2, 0); got != nil {
+		t.Fatalf("Fetch(2, 0) after Truncate(0) = %p, want nil", got)
+	}
+
+	backend.Destroy()
+}
+
+/*
+** BenchmarkFetchPageConcurrent exercises FetchPage from many goroutines
+** at once (run with -race to confirm the PGroup mutex actually guards
+** every mutation) and reports how pin/unpin throughput scales with
+** GOMAXPROCS.
+*/
+func BenchmarkFetchPageConcurrent(b *testing.B) {
+	const nPages = 128
+	pCache := newTestPageCache(4096, nPages*2)
+	for i := 0; i < nPages; i++ {
+		p := pCache.FetchPage(i)
+		pCache.Unpin(p, false)
+	}
+
+	var counter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := int(atomic.AddInt64(&counter, 1)) % nPages
+			p := pCache.FetchPage(key)
+			pCache.Unpin(p, false)
+		}
+	})
+}